@@ -1,7 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"os"
+	"strconv"
+	"strings"
+	"text/template"
 
 	"sigs.k8s.io/kustomize/kyaml/fn/framework"
 	"sigs.k8s.io/kustomize/kyaml/fn/framework/command"
@@ -11,22 +15,125 @@ import (
 
 var annotationFlag = "kustomize.treyd.io/cloud-sql-proxy"
 
+var (
+	annotationInstances     = annotationFlag + ".instances"
+	annotationImage         = annotationFlag + ".image"
+	annotationVersion       = annotationFlag + ".version"
+	annotationCPU           = annotationFlag + ".resources.cpu"
+	annotationMemory        = annotationFlag + ".resources.memory"
+	annotationExtraArgs     = annotationFlag + ".extra-args"
+	annotationRewriteImages = annotationFlag + ".rewrite-images"
+)
+
+// conventionalPodSpecPaths mirrors yaml.ConventionalContainerPaths, but
+// stops one level short at the PodSpec itself rather than its containers
+// list, since that's where fields like imagePullSecrets live.
+var conventionalPodSpecPaths = [][]string{
+	{"spec", "template", "spec"},
+	{"spec", "jobTemplate", "spec", "template", "spec"},
+	{"spec"},
+	{"template", "spec"},
+}
+
+const (
+	modeSidecar   = "sidecar"
+	modeDaemonSet = "daemonset"
+
+	defaultHealthPort = 9090
+	nonRootUID        = 65532
+
+	imageRewriteStrategyTemplate = "template"
+
+	caBundleVolumeName = "cloud-sql-proxy-ca-bundle"
+	caBundleMountPath  = "/etc/ssl/cloud-sql-proxy-ca"
+	caBundleFile       = caBundleMountPath + "/ca.crt"
+)
+
 type API struct {
 	Metadata struct {
 		Name string `yaml:"name"`
 	} `yaml:"metadata"`
 
 	Spec struct {
-		ProxyImage   *string `yaml:"proxyImage"`
-		ProxyVersion *string `yaml:"proxyVersion"`
-		ProxyInstances *string `yaml:"proxyInstances"`
+		Mode              *string        `yaml:"mode"`
+		ProxyImage        *string        `yaml:"proxyImage"`
+		ProxyVersion      *string        `yaml:"proxyVersion"`
+		ProxyMajorVersion *int           `yaml:"proxyMajorVersion"`
+		ProxyInstances    *string        `yaml:"proxyInstances"`
+		HealthPort        *int           `yaml:"healthPort"`
+		DaemonSet         *DaemonSetSpec `yaml:"daemonSet"`
+		ImageRewrite      *ImageRewrite  `yaml:"imageRewrite"`
+		Egress            *EgressSpec    `yaml:"egress"`
 	} `yaml:"spec"`
 }
 
+// EgressSpec routes the sidecar's outbound TLS connection to Cloud SQL
+// through a corporate forward proxy, for clusters without direct internet
+// egress.
+type EgressSpec struct {
+	HTTPProxy  string `yaml:"httpProxy"`
+	HTTPSProxy string `yaml:"httpsProxy"`
+	NoProxy    string `yaml:"noProxy"`
+	// CABundleConfigMap names a ConfigMap, with a "ca.crt" key, mounted
+	// into the sidecar so the proxy's TLS handshake trusts the forward
+	// proxy's certificate.
+	CABundleConfigMap string `yaml:"caBundleConfigMap"`
+}
+
+// ImageRewrite redirects proxy (and, opt-in, workload) image references
+// through a pull-through mirror registry, for air-gapped or cost-optimized
+// clusters that can't reach the upstream registries directly.
+type ImageRewrite struct {
+	Registry   string `yaml:"registry"`
+	PullSecret string `yaml:"pullSecret"`
+	// Strategy is "prefix" (default) to prepend Registry to the image
+	// reference, or "template" to render Template with {{.Registry}} and
+	// {{.Image}}.
+	Strategy string `yaml:"strategy"`
+	Template string `yaml:"template"`
+}
+
+// DaemonSetSpec configures the node-level deployment emitted when
+// Spec.Mode is "daemonset" instead of injecting a sidecar into every pod.
+type DaemonSetSpec struct {
+	NodeSelector map[string]string `yaml:"nodeSelector"`
+	Tolerations  []Toleration      `yaml:"tolerations"`
+	HostNetwork  bool              `yaml:"hostNetwork"`
+	HostPort     *int              `yaml:"hostPort"`
+}
+
+type Toleration struct {
+	Key      string `yaml:"key"`
+	Operator string `yaml:"operator"`
+	Value    string `yaml:"value"`
+	Effect   string `yaml:"effect"`
+}
+
+func mode(api API) string {
+	if api.Spec.Mode == nil {
+		return modeSidecar
+	}
+	return *api.Spec.Mode
+}
+
 func main() {
 	api := new(API)
 
 	fn := func(items []*yaml.RNode) ([]*yaml.RNode, error) {
+		if mode(*api) == modeDaemonSet {
+			for _, item := range items {
+				if err := rewriteForDaemonSet(*api, item); err != nil {
+					return nil, err
+				}
+			}
+
+			daemonSet, service, err := daemonSetResources(*api)
+			if err != nil {
+				return nil, err
+			}
+			return append(items, daemonSet, service), nil
+		}
+
 		for _, item := range items {
 			err := addSidecar(*api, item)
 			if err != nil {
@@ -54,34 +161,23 @@ func addSidecar(api API, r *yaml.RNode) error {
 		return nil
 	}
 
-	command := yaml.NewListRNode(proxyCommand(api, r.GetKind())...)
-
-	container := yaml.NewMapRNode(nil)
-	container.Pipe(
-		yaml.Tee(yaml.SetField("name", yaml.NewStringRNode("proxysql"))),
-		yaml.Tee(yaml.SetField("image", yaml.NewStringRNode(proxyImage(api)))),
-		yaml.Tee(yaml.SetField("command", command)),
-		yaml.Tee(
-			yaml.LookupCreate(yaml.MappingNode, "securityContext"),
-			yaml.SetField("runAsNonRoot", yaml.MustParse("true")),
-		),
-		yaml.Tee(
-			yaml.LookupCreate(yaml.MappingNode, "lifecycle"),
-			yaml.LookupCreate(yaml.MappingNode, "postStart"),
-			yaml.LookupCreate(yaml.MappingNode, "exec"),
-			yaml.SetField("command", yaml.NewListRNode(
-				"/bin/bash",
-				"-c",
-				"wait-for-port 5432",
-			)),
-		),
-	)
+	cfg, err := sidecarConfigFor(api, r.GetKind(), meta.Annotations)
+	if err != nil {
+		return err
+	}
+	container := proxyContainer(cfg)
 
 	containers, err := r.Pipe(yaml.LookupFirstMatch(yaml.ConventionalContainerPaths))
 	if err != nil {
 		return err
 	}
 
+	if meta.Annotations[annotationRewriteImages] == "true" {
+		if err := rewriteContainerImages(api, containers); err != nil {
+			return err
+		}
+	}
+
 	newContainers := yaml.NewListRNode()
 	newContainers.Pipe(yaml.Append(container.YNode()))
 	for _, c := range containers.Content() {
@@ -90,22 +186,609 @@ func addSidecar(api API, r *yaml.RNode) error {
 
 	containers.SetYNode(newContainers.YNode())
 
+	needsPullSecret := api.Spec.ImageRewrite != nil && api.Spec.ImageRewrite.PullSecret != ""
+	needsCABundle := api.Spec.Egress != nil && api.Spec.Egress.CABundleConfigMap != ""
+	if needsPullSecret || needsCABundle {
+		podSpec, err := r.Pipe(yaml.LookupFirstMatch(conventionalPodSpecPaths))
+		if err != nil {
+			return err
+		}
+		if needsPullSecret {
+			if err := mergeImagePullSecret(podSpec, api.Spec.ImageRewrite.PullSecret); err != nil {
+				return err
+			}
+		}
+		if needsCABundle {
+			if err := addCABundleVolume(podSpec, api.Spec.Egress.CABundleConfigMap); err != nil {
+				return err
+			}
+		}
+	}
+
 	return nil
 }
 
-func proxyImage(api API) string {
-	return *api.Spec.ProxyImage + ":" + *api.Spec.ProxyVersion
+// rewriteContainerImages applies Spec.ImageRewrite to every container's
+// image reference, for workloads opting in via the
+// kustomize.treyd.io/cloud-sql-proxy.rewrite-images annotation.
+func rewriteContainerImages(api API, containers *yaml.RNode) error {
+	for _, c := range containers.Content() {
+		container := yaml.NewRNode(c)
+		imageNode, err := container.Pipe(yaml.Lookup("image"))
+		if err != nil {
+			return err
+		}
+		if imageNode == nil {
+			continue
+		}
+
+		rewritten, err := rewriteImageRef(api, yaml.GetValue(imageNode))
+		if err != nil {
+			return err
+		}
+		if err := container.PipeE(yaml.SetField("image", yaml.NewStringRNode(rewritten))); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func proxyCommand(api API, kind string) []string {
+// mergeImagePullSecret appends secretName to a PodSpec's imagePullSecrets.
+func mergeImagePullSecret(podSpec *yaml.RNode, secretName string) error {
+	secret := yaml.NewMapRNode(nil)
+	secret.Pipe(yaml.SetField("name", yaml.NewStringRNode(secretName)))
+
+	return podSpec.PipeE(
+		yaml.LookupCreate(yaml.SequenceNode, "imagePullSecrets"),
+		yaml.Append(secret.YNode()),
+	)
+}
+
+// rewriteForDaemonSet points annotated workloads at the shared proxy
+// DaemonSet instead of injecting a sidecar: the node's loopback address
+// (hostNetwork), the node's own IP (hostPort), or the ClusterIP Service
+// fronting it, in that preference order.
+func rewriteForDaemonSet(api API, r *yaml.RNode) error {
+	meta, err := r.GetMeta()
+	if err != nil {
+		return err
+	}
+
+	if _, found := meta.Annotations[annotationFlag]; !found {
+		return nil
+	}
+
+	containers, err := r.Pipe(yaml.LookupFirstMatch(yaml.ConventionalContainerPaths))
+	if err != nil {
+		return err
+	}
+
+	host, needsPodNamespace, needsHostIP := daemonSetHost(api)
+	port := daemonSetPort(api)
+
+	var envVars []*yaml.RNode
+	if needsPodNamespace {
+		envVars = append(envVars, asFieldRefEnvVar("POD_NAMESPACE", "metadata.namespace"))
+	}
+	if needsHostIP {
+		envVars = append(envVars, asFieldRefEnvVar("HOST_IP", "status.hostIP"))
+	}
+	envVars = append(envVars,
+		asEnvVar("CLOUDSQL_PROXY_HOST", host),
+		asEnvVar("CLOUDSQL_PROXY_PORT", port),
+	)
+
+	for _, c := range containers.Content() {
+		container := yaml.NewRNode(c)
+		for _, e := range envVars {
+			if err := container.PipeE(
+				yaml.LookupCreate(yaml.SequenceNode, "env"),
+				yaml.Append(e.YNode()),
+			); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// daemonSetHost picks how a rewritten workload reaches the proxy DaemonSet:
+// loopback under hostNetwork, the pod's node IP under hostPort (each node
+// runs its own proxy instance), or otherwise the ClusterIP Service, which
+// needs the workload's own namespace to resolve its cluster-local DNS name.
+func daemonSetHost(api API) (host string, needsPodNamespace bool, needsHostIP bool) {
+	spec := api.Spec.DaemonSet
+	switch {
+	case spec != nil && spec.HostNetwork:
+		return "127.0.0.1", false, false
+	case spec != nil && spec.HostPort != nil:
+		return "$(HOST_IP)", false, true
+	default:
+		return daemonSetServiceName(api) + ".$(POD_NAMESPACE).svc.cluster.local", true, false
+	}
+}
+
+// daemonSetPort is the port a rewritten workload should connect to: the
+// configured HostPort when set, otherwise the proxy's standard 5432.
+func daemonSetPort(api API) string {
+	if api.Spec.DaemonSet != nil && api.Spec.DaemonSet.HostPort != nil {
+		return strconv.Itoa(*api.Spec.DaemonSet.HostPort)
+	}
+	return "5432"
+}
+
+func asEnvVar(name, value string) *yaml.RNode {
+	env := yaml.NewMapRNode(nil)
+	env.Pipe(
+		yaml.Tee(yaml.SetField("name", yaml.NewStringRNode(name))),
+		yaml.Tee(yaml.SetField("value", yaml.NewStringRNode(value))),
+	)
+	return env
+}
+
+// asFieldRefEnvVar builds a downward-API env var (e.g. metadata.namespace,
+// status.hostIP) for values that aren't known until the pod is scheduled.
+func asFieldRefEnvVar(name, fieldPath string) *yaml.RNode {
+	fieldRef := yaml.NewMapRNode(nil)
+	fieldRef.Pipe(yaml.SetField("fieldPath", yaml.NewStringRNode(fieldPath)))
+
+	valueFrom := yaml.NewMapRNode(nil)
+	valueFrom.Pipe(yaml.SetField("fieldRef", fieldRef))
+
+	env := yaml.NewMapRNode(nil)
+	env.Pipe(
+		yaml.Tee(yaml.SetField("name", yaml.NewStringRNode(name))),
+		yaml.Tee(yaml.SetField("valueFrom", valueFrom)),
+	)
+	return env
+}
+
+func daemonSetServiceName(api API) string {
+	return api.Metadata.Name + "-cloud-sql-proxy"
+}
+
+// daemonSetResources templates the DaemonSet that runs cloud-sql-proxy once
+// per node, and the Service used by workloads that aren't sharing its
+// network namespace.
+func daemonSetResources(api API) (*yaml.RNode, *yaml.RNode, error) {
+	spec := api.Spec.DaemonSet
+	name := daemonSetServiceName(api)
+
+	cfg, err := defaultSidecarConfig(api, "DaemonSet")
+	if err != nil {
+		return nil, nil, err
+	}
+	container := proxyContainer(cfg)
+
+	if spec != nil && spec.HostPort != nil {
+		port := yaml.NewMapRNode(nil)
+		port.Pipe(
+			yaml.Tee(yaml.SetField("name", yaml.NewStringRNode("postgres"))),
+			yaml.Tee(yaml.SetField("containerPort", yaml.MustParse("5432"))),
+			yaml.Tee(yaml.SetField("hostPort", yaml.MustParse(strconv.Itoa(*spec.HostPort)))),
+		)
+		if err := container.PipeE(
+			yaml.LookupCreate(yaml.SequenceNode, "ports"),
+			yaml.Append(port.YNode()),
+		); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	containerList := yaml.NewListRNode()
+	containerList.Pipe(yaml.Append(container.YNode()))
+
+	podSpec := yaml.NewMapRNode(nil)
+	podSpec.Pipe(
+		yaml.Tee(yaml.SetField("containers", containerList)),
+	)
+
+	if api.Spec.ImageRewrite != nil && api.Spec.ImageRewrite.PullSecret != "" {
+		if err := mergeImagePullSecret(podSpec, api.Spec.ImageRewrite.PullSecret); err != nil {
+			return nil, nil, err
+		}
+	}
+	if api.Spec.Egress != nil && api.Spec.Egress.CABundleConfigMap != "" {
+		if err := addCABundleVolume(podSpec, api.Spec.Egress.CABundleConfigMap); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if spec != nil && spec.HostNetwork {
+		podSpec.Pipe(yaml.SetField("hostNetwork", yaml.MustParse("true")))
+		podSpec.Pipe(yaml.SetField("dnsPolicy", yaml.NewStringRNode("ClusterFirstWithHostNet")))
+	}
+	if spec != nil && len(spec.NodeSelector) > 0 {
+		nodeSelector := yaml.NewMapRNode(nil)
+		for k, v := range spec.NodeSelector {
+			nodeSelector.Pipe(yaml.SetField(k, yaml.NewStringRNode(v)))
+		}
+		podSpec.Pipe(yaml.SetField("nodeSelector", nodeSelector))
+	}
+	if spec != nil && len(spec.Tolerations) > 0 {
+		tolerations := yaml.NewListRNode()
+		for _, t := range spec.Tolerations {
+			toleration := yaml.NewMapRNode(nil)
+			toleration.Pipe(
+				yaml.Tee(yaml.SetField("key", yaml.NewStringRNode(t.Key))),
+				yaml.Tee(yaml.SetField("operator", yaml.NewStringRNode(t.Operator))),
+				yaml.Tee(yaml.SetField("value", yaml.NewStringRNode(t.Value))),
+				yaml.Tee(yaml.SetField("effect", yaml.NewStringRNode(t.Effect))),
+			)
+			tolerations.Pipe(yaml.Append(toleration.YNode()))
+		}
+		podSpec.Pipe(yaml.SetField("tolerations", tolerations))
+	}
+
+	labels := yaml.NewMapRNode(nil)
+	labels.Pipe(yaml.SetField("app", yaml.NewStringRNode(name)))
+
+	podTemplate := yaml.NewMapRNode(nil)
+	podTemplate.Pipe(
+		yaml.Tee(yaml.LookupCreate(yaml.MappingNode, "metadata"), yaml.SetField("labels", labels)),
+		yaml.Tee(yaml.SetField("spec", podSpec)),
+	)
+
+	daemonSet := yaml.NewMapRNode(nil)
+	daemonSet.Pipe(
+		yaml.Tee(yaml.SetField("apiVersion", yaml.NewStringRNode("apps/v1"))),
+		yaml.Tee(yaml.SetField("kind", yaml.NewStringRNode("DaemonSet"))),
+		yaml.Tee(yaml.LookupCreate(yaml.MappingNode, "metadata"), yaml.SetField("name", yaml.NewStringRNode(name))),
+		yaml.Tee(
+			yaml.LookupCreate(yaml.MappingNode, "spec"),
+			yaml.Tee(yaml.LookupCreate(yaml.MappingNode, "selector"), yaml.SetField("matchLabels", labels)),
+			yaml.Tee(yaml.SetField("template", podTemplate)),
+		),
+	)
+
+	servicePort := yaml.NewMapRNode(nil)
+	servicePort.Pipe(
+		yaml.Tee(yaml.SetField("name", yaml.NewStringRNode("postgres"))),
+		yaml.Tee(yaml.SetField("port", yaml.MustParse("5432"))),
+		yaml.Tee(yaml.SetField("targetPort", yaml.MustParse("5432"))),
+	)
+
+	servicePortList := yaml.NewListRNode()
+	servicePortList.Pipe(yaml.Append(servicePort.YNode()))
+
+	service := yaml.NewMapRNode(nil)
+	service.Pipe(
+		yaml.Tee(yaml.SetField("apiVersion", yaml.NewStringRNode("v1"))),
+		yaml.Tee(yaml.SetField("kind", yaml.NewStringRNode("Service"))),
+		yaml.Tee(yaml.LookupCreate(yaml.MappingNode, "metadata"), yaml.SetField("name", yaml.NewStringRNode(name))),
+		yaml.Tee(
+			yaml.LookupCreate(yaml.MappingNode, "spec"),
+			yaml.Tee(yaml.SetField("selector", labels)),
+			yaml.Tee(yaml.SetField("ports", servicePortList)),
+		),
+	)
+
+	return daemonSet, service, nil
+}
+
+// sidecarConfig is the fully-resolved set of knobs needed to template the
+// proxysql container, after merging per-workload annotation overrides on
+// top of the function's Config defaults.
+type sidecarConfig struct {
+	Kind         string
+	Image        string
+	MajorVersion int
+	Instances    string
+	HealthPort   int
+	ExtraArgs    []string
+	CPU          string
+	Memory       string
+	Egress       *EgressSpec
+}
+
+// defaultSidecarConfig resolves a sidecarConfig from the API Config alone,
+// with no per-workload overrides. Used for the daemonset deployment mode,
+// which templates a single shared container.
+func defaultSidecarConfig(api API, kind string) (sidecarConfig, error) {
+	image, err := proxyImage(api)
+	if err != nil {
+		return sidecarConfig{}, err
+	}
+
+	return sidecarConfig{
+		Kind:         kind,
+		Image:        image,
+		MajorVersion: proxyMajorVersion(api),
+		Instances:    derefString(api.Spec.ProxyInstances),
+		HealthPort:   healthPort(api),
+		Egress:       api.Spec.Egress,
+	}, nil
+}
+
+// sidecarConfigFor resolves a sidecarConfig for a single workload, letting
+// its kustomize.treyd.io/cloud-sql-proxy.* annotations override the API
+// Config on a per-field basis.
+func sidecarConfigFor(api API, kind string, annotations map[string]string) (sidecarConfig, error) {
+	cfg, err := defaultSidecarConfig(api, kind)
+	if err != nil {
+		return sidecarConfig{}, err
+	}
+
+	image := derefString(api.Spec.ProxyImage)
+	if v, ok := annotations[annotationImage]; ok {
+		image = v
+	}
+	version := derefString(api.Spec.ProxyVersion)
+	if v, ok := annotations[annotationVersion]; ok {
+		version = v
+	}
+	rewritten, err := rewriteImageRef(api, image+":"+version)
+	if err != nil {
+		return sidecarConfig{}, err
+	}
+	cfg.Image = rewritten
+
+	if v, ok := annotations[annotationInstances]; ok {
+		cfg.Instances = v
+	}
+	if v, ok := annotations[annotationExtraArgs]; ok && v != "" {
+		cfg.ExtraArgs = strings.Fields(v)
+	}
+	cfg.CPU = annotations[annotationCPU]
+	cfg.Memory = annotations[annotationMemory]
+
+	return cfg, nil
+}
+
+func derefString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// proxyContainer builds the proxysql container shared by the sidecar and
+// daemonset deployment modes. On ProxyMajorVersion 2 it wires up the
+// proxy's native health endpoints as startup/readiness/liveness probes;
+// on v1, which has no health endpoint, it falls back to the postStart
+// wait-for-port workaround. Resource requests/limits are only set when the
+// config carries CPU/memory overrides.
+func proxyContainer(cfg sidecarConfig) *yaml.RNode {
+	command := yaml.NewListRNode(proxyCommand(cfg)...)
+
+	container := yaml.NewMapRNode(nil)
+	container.Pipe(
+		yaml.Tee(yaml.SetField("name", yaml.NewStringRNode("proxysql"))),
+		yaml.Tee(yaml.SetField("image", yaml.NewStringRNode(cfg.Image))),
+		yaml.Tee(yaml.SetField("command", command)),
+		yaml.Tee(yaml.SetField("securityContext", proxySecurityContext())),
+	)
+
+	if resources := resourceRequirements(cfg); resources != nil {
+		container.Pipe(yaml.Tee(yaml.SetField("resources", resources)))
+	}
+
+	if env := egressEnvVars(cfg.Egress); len(env) > 0 {
+		envList := yaml.NewListRNode()
+		for _, e := range env {
+			envList.Pipe(yaml.Append(e.YNode()))
+		}
+		container.Pipe(yaml.Tee(yaml.SetField("env", envList)))
+	}
+
+	if cfg.Egress != nil && cfg.Egress.CABundleConfigMap != "" {
+		volumeMount := yaml.NewMapRNode(nil)
+		volumeMount.Pipe(
+			yaml.Tee(yaml.SetField("name", yaml.NewStringRNode(caBundleVolumeName))),
+			yaml.Tee(yaml.SetField("mountPath", yaml.NewStringRNode(caBundleMountPath))),
+			yaml.Tee(yaml.SetField("readOnly", yaml.MustParse("true"))),
+		)
+		volumeMounts := yaml.NewListRNode()
+		volumeMounts.Pipe(yaml.Append(volumeMount.YNode()))
+		container.Pipe(yaml.Tee(yaml.SetField("volumeMounts", volumeMounts)))
+	}
+
+	if cfg.MajorVersion >= 2 {
+		healthPorts := yaml.NewListRNode()
+		healthPorts.Pipe(yaml.Append(healthContainerPort(cfg.HealthPort).YNode()))
+
+		container.Pipe(
+			yaml.Tee(yaml.SetField("ports", healthPorts)),
+			yaml.Tee(yaml.SetField("startupProbe", healthProbe(cfg.HealthPort, "/startup"))),
+			yaml.Tee(yaml.SetField("readinessProbe", healthProbe(cfg.HealthPort, "/readiness"))),
+			yaml.Tee(yaml.SetField("livenessProbe", healthProbe(cfg.HealthPort, "/liveness"))),
+		)
+	} else {
+		container.Pipe(
+			yaml.Tee(
+				yaml.LookupCreate(yaml.MappingNode, "lifecycle"),
+				yaml.LookupCreate(yaml.MappingNode, "postStart"),
+				yaml.LookupCreate(yaml.MappingNode, "exec"),
+				yaml.SetField("command", yaml.NewListRNode(
+					"/bin/bash",
+					"-c",
+					"wait-for-port 5432",
+				)),
+			),
+		)
+	}
+
+	return container
+}
+
+// egressEnvVars builds the HTTP_PROXY/HTTPS_PROXY/NO_PROXY/SSL_CERT_*
+// env vars that route the sidecar's outbound TLS handshake through a
+// corporate forward proxy, per EgressSpec.
+func egressEnvVars(egress *EgressSpec) []*yaml.RNode {
+	if egress == nil {
+		return nil
+	}
+
+	var env []*yaml.RNode
+	if egress.HTTPProxy != "" {
+		env = append(env, asEnvVar("HTTP_PROXY", egress.HTTPProxy))
+	}
+	if egress.HTTPSProxy != "" {
+		env = append(env, asEnvVar("HTTPS_PROXY", egress.HTTPSProxy))
+	}
+	if egress.NoProxy != "" {
+		env = append(env, asEnvVar("NO_PROXY", egress.NoProxy))
+	}
+	if egress.CABundleConfigMap != "" {
+		env = append(env, asEnvVar("SSL_CERT_DIR", caBundleMountPath))
+		env = append(env, asEnvVar("SSL_CERT_FILE", caBundleFile))
+	}
+	return env
+}
+
+// addCABundleVolume wires EgressSpec.CABundleConfigMap into a PodSpec's
+// volumes so the proxysql container's volumeMount has something to mount.
+func addCABundleVolume(podSpec *yaml.RNode, configMapName string) error {
+	configMapSource := yaml.NewMapRNode(nil)
+	configMapSource.Pipe(yaml.SetField("name", yaml.NewStringRNode(configMapName)))
+
+	volume := yaml.NewMapRNode(nil)
+	volume.Pipe(
+		yaml.Tee(yaml.SetField("name", yaml.NewStringRNode(caBundleVolumeName))),
+		yaml.Tee(yaml.SetField("configMap", configMapSource)),
+	)
+
+	return podSpec.PipeE(
+		yaml.LookupCreate(yaml.SequenceNode, "volumes"),
+		yaml.Append(volume.YNode()),
+	)
+}
+
+// proxySecurityContext hardens the proxysql container: non-root, no
+// writable root filesystem, and every Linux capability dropped.
+func proxySecurityContext() *yaml.RNode {
+	capabilities := yaml.NewMapRNode(nil)
+	capabilities.Pipe(yaml.Tee(yaml.SetField("drop", yaml.NewListRNode("ALL"))))
+
+	sc := yaml.NewMapRNode(nil)
+	sc.Pipe(
+		yaml.Tee(yaml.SetField("runAsNonRoot", yaml.MustParse("true"))),
+		yaml.Tee(yaml.SetField("runAsUser", yaml.MustParse(strconv.Itoa(nonRootUID)))),
+		yaml.Tee(yaml.SetField("readOnlyRootFilesystem", yaml.MustParse("true"))),
+		yaml.Tee(yaml.SetField("capabilities", capabilities)),
+	)
+	return sc
+}
+
+// resourceRequirements returns nil when neither override is set, so callers
+// can skip adding a `resources:` field entirely and keep the current
+// unconstrained behavior.
+func resourceRequirements(cfg sidecarConfig) *yaml.RNode {
+	if cfg.CPU == "" && cfg.Memory == "" {
+		return nil
+	}
+
+	resources := yaml.NewMapRNode(nil)
+	resources.Pipe(
+		yaml.Tee(yaml.SetField("requests", resourceQuantities(cfg))),
+		yaml.Tee(yaml.SetField("limits", resourceQuantities(cfg))),
+	)
+	return resources
+}
+
+func resourceQuantities(cfg sidecarConfig) *yaml.RNode {
+	quantities := yaml.NewMapRNode(nil)
+	if cfg.CPU != "" {
+		quantities.Pipe(yaml.Tee(yaml.SetField("cpu", yaml.NewStringRNode(cfg.CPU))))
+	}
+	if cfg.Memory != "" {
+		quantities.Pipe(yaml.Tee(yaml.SetField("memory", yaml.NewStringRNode(cfg.Memory))))
+	}
+	return quantities
+}
+
+func healthContainerPort(port int) *yaml.RNode {
+	p := yaml.NewMapRNode(nil)
+	p.Pipe(
+		yaml.Tee(yaml.SetField("name", yaml.NewStringRNode("health"))),
+		yaml.Tee(yaml.SetField("containerPort", yaml.MustParse(strconv.Itoa(port)))),
+	)
+	return p
+}
+
+func healthProbe(port int, path string) *yaml.RNode {
+	httpGet := yaml.NewMapRNode(nil)
+	httpGet.Pipe(
+		yaml.Tee(yaml.SetField("path", yaml.NewStringRNode(path))),
+		yaml.Tee(yaml.SetField("port", yaml.MustParse(strconv.Itoa(port)))),
+	)
+
+	probe := yaml.NewMapRNode(nil)
+	probe.Pipe(yaml.Tee(yaml.SetField("httpGet", httpGet)))
+	return probe
+}
+
+func proxyImage(api API) (string, error) {
+	return rewriteImageRef(api, derefString(api.Spec.ProxyImage)+":"+derefString(api.Spec.ProxyVersion))
+}
+
+// rewriteImageRef applies Spec.ImageRewrite to ref, if configured. With no
+// ImageRewrite set (or an empty Registry) ref is returned unchanged.
+func rewriteImageRef(api API, ref string) (string, error) {
+	rewrite := api.Spec.ImageRewrite
+	if rewrite == nil || rewrite.Registry == "" {
+		return ref, nil
+	}
+
+	if rewrite.Strategy == imageRewriteStrategyTemplate {
+		tmpl, err := template.New("imageRewrite").Parse(rewrite.Template)
+		if err != nil {
+			return "", err
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, struct {
+			Registry string
+			Image    string
+		}{rewrite.Registry, ref}); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	}
+
+	return rewrite.Registry + "/" + ref, nil
+}
+
+func proxyMajorVersion(api API) int {
+	if api.Spec.ProxyMajorVersion == nil {
+		return 1
+	}
+	return *api.Spec.ProxyMajorVersion
+}
+
+func healthPort(api API) int {
+	if api.Spec.HealthPort == nil {
+		return defaultHealthPort
+	}
+	return *api.Spec.HealthPort
+}
+
+func proxyCommand(cfg sidecarConfig) []string {
+	if cfg.MajorVersion >= 2 {
+		args := []string{
+			"/cloud-sql-proxy",
+			"--structured-logs",
+			"--auto-iam-authn",
+			"--health-check",
+			"--http-port=" + strconv.Itoa(cfg.HealthPort),
+		}
+		args = append(args, cfg.ExtraArgs...)
+		for _, instance := range strings.Split(cfg.Instances, ",") {
+			if instance = strings.TrimSpace(instance); instance != "" {
+				args = append(args, instance)
+			}
+		}
+		return args
+	}
+
 	sqlProxyCommand := []string{
 		"/cloud_sql_proxy",
 		"-term_timeout=3600s",
 		"-ip_address_types=PRIVATE",
 		"-log_debug_stdout",
-		"-instances=" + *api.Spec.ProxyInstances,
+		"-instances=" + cfg.Instances,
 		"--enable_iam_login",
 	}
 
-	return sqlProxyCommand
+	return append(sqlProxyCommand, cfg.ExtraArgs...)
 }